@@ -34,6 +34,80 @@ type Homeserver struct {
 	Users []User
 	// The list of rooms to create on this homeserver
 	Rooms []Room
+	// The list of application services registered with this homeserver. Validated by Validate.
+	// AppService.RegistrationYAML renders the registration file a homeserver expects to find for each of
+	// these; no deployer in this repo calls it and mounts the result into the homeserver container yet, so
+	// until that follow-up lands, tests must get it onto the homeserver themselves (e.g. via the homeserver's
+	// own config) before pointing one at client.NewASAPI.
+	AppServices []AppService
+}
+
+// AppService represents an application service registered with a Homeserver. See Homeserver.AppServices for
+// the current limits on how this is deployed, and AppService.RegistrationYAML for the file a homeserver
+// expects to find for it.
+type AppService struct {
+	// ID is the application service's unique ID, used in the registration file.
+	ID string
+	// URL is the base URL the homeserver should push transactions to, e.g. http://localhost:9000.
+	URL string
+	// HSToken is the token the homeserver uses to authenticate the transactions it pushes to the application service.
+	HSToken string
+	// ASToken is the token the homeserver uses to authenticate requests it receives from the application service.
+	ASToken string
+	// SenderLocalpart is the localpart of the user associated with this application service.
+	SenderLocalpart string
+	// Namespaces this application service exclusively or non-exclusively owns.
+	Namespaces AppServiceNamespaces
+}
+
+// AppServiceNamespaces groups the three kinds of namespace an AppService can register.
+type AppServiceNamespaces struct {
+	Users   []AppServiceNamespace
+	Aliases []AppServiceNamespace
+	Rooms   []AppServiceNamespace
+}
+
+// AppServiceNamespace is a single regex namespace entry in an application service's registration.
+type AppServiceNamespace struct {
+	Regex     string
+	Exclusive bool
+}
+
+// RegistrationYAML renders as as the application service registration file a homeserver expects to be
+// pointed at (e.g. via Synapse's `app_service_config_files`), so a deployer can write it to disk and mount
+// it into the homeserver container alongside its config.
+func (as AppService) RegistrationYAML() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "id: %s\n", yamlString(as.ID))
+	fmt.Fprintf(&sb, "url: %s\n", yamlString(as.URL))
+	fmt.Fprintf(&sb, "as_token: %s\n", yamlString(as.ASToken))
+	fmt.Fprintf(&sb, "hs_token: %s\n", yamlString(as.HSToken))
+	fmt.Fprintf(&sb, "sender_localpart: %s\n", yamlString(as.SenderLocalpart))
+	sb.WriteString("namespaces:\n")
+	writeAppServiceNamespaces(&sb, "users", as.Namespaces.Users)
+	writeAppServiceNamespaces(&sb, "aliases", as.Namespaces.Aliases)
+	writeAppServiceNamespaces(&sb, "rooms", as.Namespaces.Rooms)
+	sb.WriteString("rate_limited: false\n")
+	return sb.String()
+}
+
+// writeAppServiceNamespaces appends the `key:` namespace list entry of an AppService registration file to sb.
+func writeAppServiceNamespaces(sb *strings.Builder, key string, namespaces []AppServiceNamespace) {
+	if len(namespaces) == 0 {
+		fmt.Fprintf(sb, "  %s: []\n", key)
+		return
+	}
+	fmt.Fprintf(sb, "  %s:\n", key)
+	for _, ns := range namespaces {
+		fmt.Fprintf(sb, "    - exclusive: %t\n      regex: %s\n", ns.Exclusive, yamlString(ns.Regex))
+	}
+}
+
+// yamlString renders s as a double-quoted YAML scalar, escaping the characters that need it.
+func yamlString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
 }
 
 type User struct {
@@ -50,12 +124,18 @@ type AccountData struct {
 
 type Room struct {
 	// The unique reference for this room. Used to link together rooms across homeservers.
-	Ref        string
+	Ref string
+	// The room version to create this room as. If empty, the homeserver's default room version is used.
+	// Must be one of the versions in SupportedRoomVersions.
+	Version    string
 	Creator    string
 	CreateRoom map[string]interface{}
 	Events     []Event
 }
 
+// SupportedRoomVersions are the room versions which can be set on Room.Version.
+var SupportedRoomVersions = []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"}
+
 type Event struct {
 	Type     string
 	Sender   string
@@ -93,6 +173,17 @@ func Validate(bp Blueprint) (Blueprint, error) {
 				return bp, err
 			}
 		}
+		for _, as := range hs.AppServices {
+			if as.ID == "" {
+				return bp, fmt.Errorf("HS %s appservice must have an ID", hs.Name)
+			}
+			if as.URL == "" {
+				return bp, fmt.Errorf("HS %s appservice '%s' must have a URL", hs.Name, as.ID)
+			}
+			if as.SenderLocalpart == "" {
+				return bp, fmt.Errorf("HS %s appservice '%s' must have a SenderLocalpart", hs.Name, as.ID)
+			}
+		}
 	}
 	return bp, nil
 }
@@ -107,6 +198,15 @@ func normaliseRoom(hsName string, r Room) (Room, error) {
 	} else if r.Ref == "" {
 		return r, fmt.Errorf("%s : room must have either a Ref or a Creator", hsName)
 	}
+	if r.Version != "" {
+		if !isSupportedRoomVersion(r.Version) {
+			return r, fmt.Errorf("%s : room version '%s' is not supported, must be one of %v", hsName, r.Version, SupportedRoomVersions)
+		}
+		if r.CreateRoom == nil {
+			r.CreateRoom = make(map[string]interface{})
+		}
+		r.CreateRoom["room_version"] = r.Version
+	}
 	for i := range r.Events {
 		r.Events[i].Sender, err = normaliseUser(r.Events[i].Sender, hsName)
 		if err != nil {
@@ -138,6 +238,15 @@ func normaliseUser(u string, hsName string) (string, error) {
 	return u, nil
 }
 
+func isSupportedRoomVersion(v string) bool {
+	for _, supported := range SupportedRoomVersions {
+		if v == supported {
+			return true
+		}
+	}
+	return false
+}
+
 // Ptr returns a pointer to `in`, because Go doesn't allow you to inline this.
 func Ptr(in string) *string {
 	return &in
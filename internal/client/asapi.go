@@ -0,0 +1,114 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Transaction is a single `PUT /transactions/{txnID}` pushed to an application service by its homeserver.
+type Transaction struct {
+	TxnID  string
+	Events []gjson.Result
+	EDUs   []gjson.Result
+}
+
+// ASAPI mirrors CSAPI but authenticates as an application service rather than a regular user, and can
+// additionally receive transactions pushed to it by the homeserver.
+type ASAPI struct {
+	*CSAPI
+	// ASToken is used to authenticate requests this appservice makes to the homeserver, in place of
+	// CSAPI.AccessToken.
+	ASToken string
+	// HSToken is used to authenticate transactions the homeserver pushes to this appservice.
+	HSToken string
+
+	srv          *http.Server
+	transactions chan Transaction
+}
+
+// NewASAPI returns an ASAPI which authenticates as the given application service, acting as `senderUserID`
+// for client-server requests made via the embedded CSAPI.
+func NewASAPI(t *testing.T, baseURL, asToken, hsToken, senderUserID string) *ASAPI {
+	t.Helper()
+	return &ASAPI{
+		CSAPI: &CSAPI{
+			UserID:           senderUserID,
+			AccessToken:      asToken,
+			BaseURL:          baseURL,
+			Client:           &http.Client{},
+			SyncUntilTimeout: 10 * time.Second,
+		},
+		ASToken:      asToken,
+		HSToken:      hsToken,
+		transactions: make(chan Transaction, 100),
+	}
+}
+
+// Listen starts an HTTP server on `addr` which accepts transactions pushed by the homeserver, validating
+// the HSToken it was configured with. Received transactions are available from TransactionsReceived.
+// Fails the test if the listener cannot be started.
+func (a *ASAPI) Listen(t *testing.T, addr string) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transactions/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("access_token") != a.HSToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		txn := Transaction{
+			TxnID:  lastPathSegment(req.URL.Path),
+			Events: gjson.GetBytes(body, "events").Array(),
+			EDUs:   gjson.GetBytes(body, "ephemeral").Array(),
+		}
+		a.transactions <- txn
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("/_matrix/app/v1/thirdparty/", func(w http.ResponseWriter, req *http.Request) {
+		// No third party lookups are configured; every lookup is answered with an empty list.
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+	})
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("ASAPI.Listen: failed to bind %s: %s", addr, err)
+	}
+	a.srv = &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := a.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			t.Logf("ASAPI.Listen: server stopped: %s", err)
+		}
+	}()
+}
+
+// Close stops the transaction-receiving HTTP server started by Listen.
+func (a *ASAPI) Close() {
+	if a.srv != nil {
+		a.srv.Close()
+	}
+}
+
+// TransactionsReceived returns the channel transactions pushed by the homeserver are delivered on.
+func (a *ASAPI) TransactionsReceived() <-chan Transaction {
+	return a.transactions
+}
+
+// lastPathSegment returns the final `/`-separated segment of p.
+func lastPathSegment(p string) string {
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] == '/' {
+			return p[i+1:]
+		}
+	}
+	return p
+}
@@ -37,6 +37,160 @@ func (c *CSAPI) CreateRoom(t *testing.T, creationContent interface{}) string {
 	return getJSONFieldStr(t, body, "room_id")
 }
 
+// Register creates a new account on the homeserver with the given localpart/password using the dummy auth
+// flow, and returns a CSAPI logged in as that user. `kind` is "user" or "guest", matching the `kind` query
+// parameter accepted by `POST /register`.
+func (c *CSAPI) Register(t *testing.T, localpart, password, kind string) *CSAPI {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"username": localpart,
+		"password": password,
+		"auth": map[string]interface{}{
+			"type": "m.login.dummy",
+		},
+	}
+	query := url.Values{}
+	if kind != "" {
+		query.Set("kind", kind)
+	}
+	res, err := c.Do(t, "POST", []string{"_matrix", "client", "r0", "register"}, reqBody, query)
+	if err != nil {
+		t.Fatalf("CSAPI.Register error: %s", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		t.Fatalf("CSAPI.Register returned HTTP %d", res.StatusCode)
+	}
+	body := parseJSON(t, res)
+	return &CSAPI{
+		UserID:           getJSONFieldStr(t, body, "user_id"),
+		AccessToken:      getJSONFieldStr(t, body, "access_token"),
+		BaseURL:          c.BaseURL,
+		Client:           c.Client,
+		SyncUntilTimeout: c.SyncUntilTimeout,
+		Debug:            c.Debug,
+	}
+}
+
+// Login logs in as `user` with `password`, optionally requesting `deviceID`, and returns a CSAPI for the
+// newly created session.
+func (c *CSAPI) Login(t *testing.T, user, password, deviceID string) *CSAPI {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"type": "m.login.password",
+		"identifier": map[string]interface{}{
+			"type": "m.id.user",
+			"user": user,
+		},
+		"password": password,
+	}
+	if deviceID != "" {
+		reqBody["device_id"] = deviceID
+	}
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "login"}, reqBody)
+	body := parseJSON(t, res)
+	return &CSAPI{
+		UserID:           getJSONFieldStr(t, body, "user_id"),
+		AccessToken:      getJSONFieldStr(t, body, "access_token"),
+		BaseURL:          c.BaseURL,
+		Client:           c.Client,
+		SyncUntilTimeout: c.SyncUntilTimeout,
+		Debug:            c.Debug,
+	}
+}
+
+// Logout invalidates this session's access token. Fails the test on error.
+func (c *CSAPI) Logout(t *testing.T) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "logout"}, struct{}{})
+}
+
+// UploadContent uploads `body` (named `filename`, with the given `contentType`) to the content repository,
+// returning the resulting `mxc://` URI. Fails the test on error.
+func (c *CSAPI) UploadContent(t *testing.T, body []byte, filename, contentType string) string {
+	t.Helper()
+	query := url.Values{
+		"access_token": []string{c.AccessToken},
+		"filename":     []string{filename},
+	}
+	reqURL := c.BaseURL + "/_matrix/media/r0/upload?" + query.Encode()
+	req, err := http.NewRequest("POST", reqURL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("CSAPI.UploadContent failed to create http.NewRequest: %s", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := c.Client.Do(req)
+	if err != nil {
+		t.Fatalf("CSAPI.UploadContent request error: %s", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		t.Fatalf("CSAPI.UploadContent returned HTTP %d", res.StatusCode)
+	}
+	resBody := parseJSON(t, res)
+	return getJSONFieldStr(t, resBody, "content_uri")
+}
+
+// DownloadContent downloads the given `mxc://` URI from the content repository, returning the raw bytes and
+// the `Content-Type` the homeserver served it with. Fails the test on error.
+func (c *CSAPI) DownloadContent(t *testing.T, mxcURI string) ([]byte, string) {
+	t.Helper()
+	origin, mediaID := split2(strings.TrimPrefix(mxcURI, "mxc://"), '/')
+	res := c.MustDo(t, "GET", []string{"_matrix", "media", "r0", "download", origin, mediaID}, nil)
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("CSAPI.DownloadContent failed to read response body: %s", err)
+	}
+	return b, res.Header.Get("Content-Type")
+}
+
+// Invite invites userID to roomID. Fails the test on error.
+func (c *CSAPI) Invite(t *testing.T, roomID, userID string) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "invite"}, map[string]interface{}{
+		"user_id": userID,
+	})
+}
+
+// Leave leaves roomID as this user. Fails the test on error.
+func (c *CSAPI) Leave(t *testing.T, roomID string) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "leave"}, struct{}{})
+}
+
+// Kick kicks userID from roomID, optionally giving a reason. Fails the test on error.
+func (c *CSAPI) Kick(t *testing.T, roomID, userID, reason string) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "kick"}, map[string]interface{}{
+		"user_id": userID,
+		"reason":  reason,
+	})
+}
+
+// Ban bans userID from roomID, optionally giving a reason. Fails the test on error.
+func (c *CSAPI) Ban(t *testing.T, roomID, userID, reason string) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "ban"}, map[string]interface{}{
+		"user_id": userID,
+		"reason":  reason,
+	})
+}
+
+// Forget forgets roomID for this user. Fails the test on error.
+func (c *CSAPI) Forget(t *testing.T, roomID string) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "r0", "rooms", roomID, "forget"}, struct{}{})
+}
+
+// split2 splits s on the first occurrence of sep, returning "", s if sep is not present.
+func split2(s string, sep byte) (string, string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == sep {
+			return s[:i], s[i+1:]
+		}
+	}
+	return "", s
+}
+
 // JoinRoom joins the room ID or alias given, else fails the test. Returns the room ID.
 func (c *CSAPI) JoinRoom(t *testing.T, roomIDOrAlias string) string {
 	t.Helper()
@@ -71,10 +225,116 @@ func (c *CSAPI) SendEventSynced(t *testing.T, roomID string, e b.Event) {
 // Will time out after CSAPI.SyncUntilTimeout.
 func (c *CSAPI) SyncUntilTimelineHas(t *testing.T, roomID string, check func(gjson.Result) bool) {
 	t.Helper()
-	c.syncUntil(t, "", "rooms.join."+gjsonEscape(roomID)+".timeline.events", check)
+	c.syncUntil(t, "", roomID, check)
+}
+
+// JoinedRoomSync is the `rooms.join.<room_id>` object in a /sync response: the timeline, state, ephemeral
+// and account data events a joined room gained since the last sync.
+type JoinedRoomSync struct {
+	Timeline struct {
+		Events    []gjson.Result
+		Limited   bool
+		PrevBatch string
+	}
+	State struct {
+		Events []gjson.Result
+	}
+	Ephemeral struct {
+		Events []gjson.Result
+	}
+	AccountData struct {
+		Events []gjson.Result
+	}
 }
 
-func (c *CSAPI) syncUntil(t *testing.T, since, key string, check func(gjson.Result) bool) {
+// SyncResponse is a typed view of the JSON body returned by `GET /sync`, covering the fields tests most
+// commonly need. Use SyncOnce to fetch one, or gjson directly on the raw response for anything not covered
+// here.
+type SyncResponse struct {
+	NextBatch string
+	Rooms     struct {
+		Join map[string]JoinedRoomSync
+	}
+	Presence struct {
+		Events []gjson.Result
+	}
+	ToDevice struct {
+		Events []gjson.Result
+	}
+	DeviceLists struct {
+		Changed []string
+		Left    []string
+	}
+	DeviceOneTimeKeysCount map[string]int
+}
+
+// SyncOnce calls `GET /sync` a single time with the given `since` token (use "" for an initial sync) and
+// returns a typed view of the response. Fails the test on error.
+func (c *CSAPI) SyncOnce(t *testing.T, since string) *SyncResponse {
+	t.Helper()
+	body, _ := c.rawSync(t, since)
+	res := &SyncResponse{
+		NextBatch: getJSONFieldStr(t, body, "next_batch"),
+	}
+	res.Rooms.Join = make(map[string]JoinedRoomSync)
+	gjson.GetBytes(body, "rooms.join").ForEach(func(roomID, room gjson.Result) bool {
+		var joined JoinedRoomSync
+		joined.Timeline.Events = room.Get("timeline.events").Array()
+		joined.Timeline.Limited = room.Get("timeline.limited").Bool()
+		joined.Timeline.PrevBatch = room.Get("timeline.prev_batch").Str
+		joined.State.Events = room.Get("state.events").Array()
+		joined.Ephemeral.Events = room.Get("ephemeral.events").Array()
+		joined.AccountData.Events = room.Get("account_data.events").Array()
+		res.Rooms.Join[roomID.Str] = joined
+		return true
+	})
+	res.Presence.Events = gjson.GetBytes(body, "presence.events").Array()
+	res.ToDevice.Events = gjson.GetBytes(body, "to_device.events").Array()
+	res.DeviceLists.Changed = strArray(gjson.GetBytes(body, "device_lists.changed"))
+	res.DeviceLists.Left = strArray(gjson.GetBytes(body, "device_lists.left"))
+	res.DeviceOneTimeKeysCount = make(map[string]int)
+	gjson.GetBytes(body, "device_one_time_keys_count").ForEach(func(algo, count gjson.Result) bool {
+		res.DeviceOneTimeKeysCount[algo.Str] = int(count.Int())
+		return true
+	})
+	return res
+}
+
+// strArray returns the string values of a gjson array result.
+func strArray(res gjson.Result) []string {
+	arr := res.Array()
+	out := make([]string, len(arr))
+	for i, v := range arr {
+		out[i] = v.Str
+	}
+	return out
+}
+
+// rawSync performs a single `GET /sync` call and returns the raw response body along with the next_batch
+// token, for callers which need the full JSON rather than the typed SyncResponse view.
+func (c *CSAPI) rawSync(t *testing.T, since string) ([]byte, string) {
+	t.Helper()
+	query := url.Values{
+		"access_token": []string{c.AccessToken},
+		"timeout":      []string{"1000"},
+	}
+	if since != "" {
+		query["since"] = []string{since}
+	}
+	res, err := c.Do(t, "GET", []string{"_matrix", "client", "r0", "sync"}, nil, query)
+	if err != nil {
+		t.Fatalf("CSAPI.rawSync since=%s error: %s", since, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		t.Fatalf("CSAPI.rawSync since=%s returned HTTP %d", since, res.StatusCode)
+	}
+	body := parseJSON(t, res)
+	return body, getJSONFieldStr(t, body, "next_batch")
+}
+
+// syncUntil calls SyncOnce in a loop, checking each timeline event of roomID as it arrives, until check
+// returns true or CSAPI.SyncUntilTimeout elapses.
+func (c *CSAPI) syncUntil(t *testing.T, since, roomID string, check func(gjson.Result) bool) {
 	t.Helper()
 	start := time.Now()
 	checkCounter := 0
@@ -82,38 +342,24 @@ func (c *CSAPI) syncUntil(t *testing.T, since, key string, check func(gjson.Resu
 		if time.Now().Sub(start) > c.SyncUntilTimeout {
 			t.Fatalf("syncUntil timed out. Called check function %d times", checkCounter)
 		}
-		query := url.Values{
-			"access_token": []string{c.AccessToken},
-			"timeout":      []string{"1000"},
-		}
-		if since != "" {
-			query["since"] = []string{since}
-		}
-		res, err := c.Do(t, "GET", []string{"_matrix", "client", "r0", "sync"}, nil, query)
-		if err != nil {
-			t.Fatalf("CSAPI.syncUntil since=%s error: %s", since, err)
-		}
-		if res.StatusCode < 200 || res.StatusCode >= 300 {
-			t.Fatalf("CSAPI.syncUntil since=%s returned HTTP %d", since, res.StatusCode)
+		res := c.SyncOnce(t, since)
+		since = res.NextBatch
+		room, ok := res.Rooms.Join[roomID]
+		if !ok {
+			continue
 		}
-		body := parseJSON(t, res)
-		since = getJSONFieldStr(t, body, "next_batch")
-		keyRes := gjson.GetBytes(body, key)
-		if keyRes.IsArray() {
-			events := keyRes.Array()
-			for _, ev := range events {
-				wasFailed := t.Failed()
-				if check(ev) {
-					if !wasFailed && t.Failed() {
-						t.Logf("failing event %s", ev.Raw)
-					}
-					return
-				}
+		for _, ev := range room.Timeline.Events {
+			wasFailed := t.Failed()
+			if check(ev) {
 				if !wasFailed && t.Failed() {
 					t.Logf("failing event %s", ev.Raw)
 				}
-				checkCounter++
+				return
 			}
+			if !wasFailed && t.Failed() {
+				t.Logf("failing event %s", ev.Raw)
+			}
+			checkCounter++
 		}
 	}
 }
@@ -232,10 +478,3 @@ func parseJSON(t *testing.T, res *http.Response) []byte {
 	}
 	return body
 }
-
-// gjsonEscape escapes . and * from the input so it can be used with gjson.Get
-func gjsonEscape(in string) string {
-	in = strings.ReplaceAll(in, ".", `\.`)
-	in = strings.ReplaceAll(in, "*", `\*`)
-	return in
-}
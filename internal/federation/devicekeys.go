@@ -0,0 +1,398 @@
+package federation
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// KeyQueryBehaviour controls how HandleUserDeviceQueries answers `/user/keys/query` requests for a given
+// user, so tests can simulate a slow or broken remote homeserver while racing the "joined hosts" recalculation.
+type KeyQueryBehaviour struct {
+	// Delay, if set, is how long to wait before answering the request.
+	Delay time.Duration
+	// Err, if set, causes the handler to respond with a 500 instead of the configured device keys.
+	Err error
+}
+
+// eduRingBuffer stores received EDUs of a given type, bounded to the most recent entries so long-running
+// tests don't leak memory.
+type eduRingBuffer struct {
+	mu      sync.Mutex
+	maxSize int
+	edus    map[string][]gjson.Result
+}
+
+func newEDURingBuffer(maxSize int) *eduRingBuffer {
+	return &eduRingBuffer{
+		maxSize: maxSize,
+		edus:    make(map[string][]gjson.Result),
+	}
+}
+
+// deviceKeyStore holds device keys registered via Server.MustAddDeviceKeys, guarded by a mutex since it is
+// written by the test goroutine and read by HandleUserDeviceQueries' request-handling goroutines concurrently.
+type deviceKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]DeviceKeys
+}
+
+func newDeviceKeyStore() *deviceKeyStore {
+	return &deviceKeyStore{keys: make(map[string][]DeviceKeys)}
+}
+
+func (d *deviceKeyStore) Add(userID string, dk DeviceKeys) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys[userID] = append(d.keys[userID], dk)
+}
+
+func (d *deviceKeyStore) Get(userID string) []DeviceKeys {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	devices := d.keys[userID]
+	out := make([]DeviceKeys, len(devices))
+	copy(out, devices)
+	return out
+}
+
+// keyQueryBehaviourStore holds the per-user KeyQueryBehaviour set via Server.SetKeyQueryBehaviour, guarded by
+// a mutex since tests mutate it from a separate goroutine while a previous `/user/keys/query` request may
+// still be in flight, to drive races around joined hosts recalculation.
+type keyQueryBehaviourStore struct {
+	mu        sync.Mutex
+	behaviour map[string]KeyQueryBehaviour
+}
+
+func newKeyQueryBehaviourStore() *keyQueryBehaviourStore {
+	return &keyQueryBehaviourStore{behaviour: make(map[string]KeyQueryBehaviour)}
+}
+
+func (k *keyQueryBehaviourStore) Set(userID string, behaviour KeyQueryBehaviour) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.behaviour[userID] = behaviour
+}
+
+func (k *keyQueryBehaviourStore) Get(userID string) (KeyQueryBehaviour, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	behaviour, ok := k.behaviour[userID]
+	return behaviour, ok
+}
+
+// CrossSigningKeyUsage is the `usage` of a cross-signing key. Complement only serves `master` and
+// `self_signing` keys, since `user_signing_keys` are a client-server API concept not returned by the
+// federation `/user/keys/query` endpoint HandleUserDeviceQueries implements.
+type CrossSigningKeyUsage string
+
+const (
+	CrossSigningKeyUsageMaster      CrossSigningKeyUsage = "master"
+	CrossSigningKeyUsageSelfSigning CrossSigningKeyUsage = "self_signing"
+)
+
+// crossSigningKeyStore holds cross-signing keys registered via Server.MustAddCrossSigningKey, guarded by a
+// mutex for the same reason as deviceKeyStore.
+type crossSigningKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]map[CrossSigningKeyUsage]map[string]interface{}
+}
+
+func newCrossSigningKeyStore() *crossSigningKeyStore {
+	return &crossSigningKeyStore{keys: make(map[string]map[CrossSigningKeyUsage]map[string]interface{})}
+}
+
+func (c *crossSigningKeyStore) Set(userID string, usage CrossSigningKeyUsage, signed map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys[userID] == nil {
+		c.keys[userID] = make(map[CrossSigningKeyUsage]map[string]interface{})
+	}
+	c.keys[userID][usage] = signed
+}
+
+func (c *crossSigningKeyStore) Get(userID string, usage CrossSigningKeyUsage) (map[string]interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	signed, ok := c.keys[userID][usage]
+	return signed, ok
+}
+
+func (r *eduRingBuffer) Add(eduType string, content gjson.Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := append(r.edus[eduType], content)
+	if len(entries) > r.maxSize {
+		entries = entries[len(entries)-r.maxSize:]
+	}
+	r.edus[eduType] = entries
+}
+
+func (r *eduRingBuffer) Get(eduType string) []gjson.Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := r.edus[eduType]
+	out := make([]gjson.Result, len(entries))
+	copy(out, entries)
+	return out
+}
+
+// ReceivedEDUs returns the EDUs of the given `edutype` (e.g "m.device_list_update") received by this server
+// via HandleKeyChanges, oldest first. Only the 20 most recent EDUs of each type are kept. Useful for asserting that a homeserver forwarded a device key change
+// EDU after a local user joined a federated room.
+func (s *Server) ReceivedEDUs(edutype string) []gjson.Result {
+	if s.eduRingBuffer == nil {
+		return nil
+	}
+	return s.eduRingBuffer.Get(edutype)
+}
+
+// HandleKeyChanges is an option which mounts `/_matrix/federation/v1/send/{txnID}` and records any
+// `m.device_list_update` or `m.signing_key_update` EDUs it receives, retrievable via Server.ReceivedEDUs.
+// PDUs in the transaction are acknowledged but otherwise ignored.
+func HandleKeyChanges() func(*Server) {
+	return func(s *Server) {
+		if s.eduRingBuffer == nil {
+			s.eduRingBuffer = newEDURingBuffer(20)
+		}
+		s.mux.Handle("/_matrix/federation/v1/send/{txnID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			edus := gjson.GetBytes(fedReq.Content(), "edus")
+			for _, edu := range edus.Array() {
+				eduType := edu.Get("edu_type").Str
+				switch eduType {
+				case "m.device_list_update", "m.signing_key_update":
+					s.eduRingBuffer.Add(eduType, edu.Get("content"))
+				}
+			}
+			w.WriteHeader(200)
+			w.Write([]byte(`{"pdus":{}}`))
+		})).Methods("PUT")
+	}
+}
+
+// HandleUserDeviceQueries is an option which serves `/user/devices/{userID}`, `/user/keys/query` and
+// `/user/keys/claim` from device keys previously registered with Server.MustAddDeviceKeys and cross-signing
+// keys registered with Server.MustAddCrossSigningKey. Use Server.SetKeyQueryBehaviour to make a given user's
+// responses arrive late or fail, to drive races around key change propagation.
+func HandleUserDeviceQueries() func(*Server) {
+	return func(s *Server) {
+		if s.deviceKeys == nil {
+			s.deviceKeys = newDeviceKeyStore()
+		}
+		if s.keyQueryBehaviour == nil {
+			s.keyQueryBehaviour = newKeyQueryBehaviourStore()
+		}
+		if s.crossSigningKeys == nil {
+			s.crossSigningKeys = newCrossSigningKeyStore()
+		}
+		s.mux.Handle("/_matrix/federation/v1/user/devices/{userID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			userID := mux.Vars(req)["userID"]
+			if !s.applyKeyQueryBehaviour(w, userID) {
+				return
+			}
+			devices := s.deviceKeys.Get(userID)
+			res := map[string]interface{}{
+				"user_id":   userID,
+				"stream_id": len(devices),
+				"devices":   devices,
+			}
+			b, _ := json.Marshal(res)
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+
+		s.mux.Handle("/_matrix/federation/v1/user/keys/query", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			deviceKeys := make(map[string]interface{})
+			masterKeys := make(map[string]interface{})
+			selfSigningKeys := make(map[string]interface{})
+			for userID := range gjson.GetBytes(fedReq.Content(), "device_keys").Map() {
+				if !s.applyKeyQueryBehaviour(w, userID) {
+					return
+				}
+				userDeviceKeys := make(map[string]interface{})
+				for _, dk := range s.deviceKeys.Get(userID) {
+					userDeviceKeys[dk.DeviceID] = dk.Signed
+				}
+				deviceKeys[userID] = userDeviceKeys
+				if signed, ok := s.crossSigningKeys.Get(userID, CrossSigningKeyUsageMaster); ok {
+					masterKeys[userID] = signed
+				}
+				if signed, ok := s.crossSigningKeys.Get(userID, CrossSigningKeyUsageSelfSigning); ok {
+					selfSigningKeys[userID] = signed
+				}
+			}
+			b, _ := json.Marshal(map[string]interface{}{
+				"device_keys":       deviceKeys,
+				"master_keys":       masterKeys,
+				"self_signing_keys": selfSigningKeys,
+			})
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("POST")
+
+		s.mux.Handle("/_matrix/federation/v1/user/keys/claim", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			// complement doesn't track one-time keys, so every claim is answered with an empty
+			// `one_time_keys` map.
+			b, _ := json.Marshal(map[string]interface{}{"one_time_keys": map[string]interface{}{}})
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("POST")
+	}
+}
+
+// applyKeyQueryBehaviour sleeps/errors according to the configured KeyQueryBehaviour for userID, returning
+// false (having already written the response) if the caller should stop processing this request.
+func (s *Server) applyKeyQueryBehaviour(w http.ResponseWriter, userID string) bool {
+	behaviour, ok := s.keyQueryBehaviour.Get(userID)
+	if !ok {
+		return true
+	}
+	if behaviour.Delay > 0 {
+		time.Sleep(behaviour.Delay)
+	}
+	if behaviour.Err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("complement: HandleUserDeviceQueries configured error for " + userID + ": " + behaviour.Err.Error()))
+		return false
+	}
+	return true
+}
+
+// SetKeyQueryBehaviour configures how this server answers key queries for userID, letting tests simulate
+// a slow or failing remote homeserver.
+func (s *Server) SetKeyQueryBehaviour(userID string, behaviour KeyQueryBehaviour) {
+	if s.keyQueryBehaviour == nil {
+		s.keyQueryBehaviour = newKeyQueryBehaviourStore()
+	}
+	s.keyQueryBehaviour.Set(userID, behaviour)
+}
+
+// DeviceKeys is a single device's identity keys, signed and ready to be served from
+// `/user/keys/query` and `/user/devices/{userID}`.
+type DeviceKeys struct {
+	DeviceID string                 `json:"device_id"`
+	Signed   map[string]interface{} `json:"keys"`
+}
+
+// MustAddDeviceKeys generates a fresh ed25519 device key for (userID, deviceID), signs it as this server,
+// and registers it so HandleUserDeviceQueries will serve it. Returns the signing key so the
+// test can also sign further objects (e.g. cross-signing keys) as this device.
+func (s *Server) MustAddDeviceKeys(userID, deviceID string) ed25519.PrivateKey {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic("complement: MustAddDeviceKeys failed to generate ed25519 key: " + err.Error())
+	}
+	keyID := "ed25519:" + deviceID
+	unsigned := map[string]interface{}{
+		"user_id":    userID,
+		"device_id":  deviceID,
+		"algorithms": []string{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
+		"keys": map[string]string{
+			keyID: base64.RawStdEncoding.EncodeToString(pub),
+		},
+	}
+	toSign, err := json.Marshal(unsigned)
+	if err != nil {
+		panic("complement: MustAddDeviceKeys failed to marshal device keys: " + err.Error())
+	}
+	signedJSON, err := gomatrixserverlib.SignJSON(s.ServerName, s.KeyID, s.Priv, toSign)
+	if err != nil {
+		panic("complement: MustAddDeviceKeys failed to sign device keys: " + err.Error())
+	}
+	var signed map[string]interface{}
+	if err := json.Unmarshal(signedJSON, &signed); err != nil {
+		panic("complement: MustAddDeviceKeys failed to unmarshal signed device keys: " + err.Error())
+	}
+	if s.deviceKeys == nil {
+		s.deviceKeys = newDeviceKeyStore()
+	}
+	s.deviceKeys.Add(userID, DeviceKeys{
+		DeviceID: deviceID,
+		Signed:   signed,
+	})
+	return priv
+}
+
+// MustAddCrossSigningKey generates a fresh ed25519 cross-signing key of the given usage for userID, and
+// registers it so HandleUserDeviceQueries will serve it in `/user/keys/query`'s `master_keys`/
+// `self_signing_keys`. The key is signed by signerKeyID/signerPriv; pass "", nil to self-sign, as master keys
+// normally are, or pass back a prior call's returned key ID/private key to sign a self_signing key with the
+// user's master key, per the cross-signing spec. Returns the new key's ID (`ed25519:<pubkey>`) and private
+// key so the test can use it to sign further objects.
+func (s *Server) MustAddCrossSigningKey(userID string, usage CrossSigningKeyUsage, signerKeyID string, signerPriv ed25519.PrivateKey) (string, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic("complement: MustAddCrossSigningKey failed to generate ed25519 key: " + err.Error())
+	}
+	keyID := "ed25519:" + base64.RawStdEncoding.EncodeToString(pub)
+	unsigned := map[string]interface{}{
+		"user_id": userID,
+		"usage":   []string{string(usage)},
+		"keys": map[string]string{
+			keyID: base64.RawStdEncoding.EncodeToString(pub),
+		},
+	}
+	toSign, err := json.Marshal(unsigned)
+	if err != nil {
+		panic("complement: MustAddCrossSigningKey failed to marshal key: " + err.Error())
+	}
+	if signerPriv == nil {
+		signerKeyID, signerPriv = keyID, priv
+	}
+	signedJSON, err := gomatrixserverlib.SignJSON(userID, gomatrixserverlib.KeyID(signerKeyID), signerPriv, toSign)
+	if err != nil {
+		panic("complement: MustAddCrossSigningKey failed to sign key: " + err.Error())
+	}
+	var signed map[string]interface{}
+	if err := json.Unmarshal(signedJSON, &signed); err != nil {
+		panic("complement: MustAddCrossSigningKey failed to unmarshal signed key: " + err.Error())
+	}
+	if s.crossSigningKeys == nil {
+		s.crossSigningKeys = newCrossSigningKeyStore()
+	}
+	s.crossSigningKeys.Set(userID, usage, signed)
+	return keyID, priv
+}
@@ -0,0 +1,275 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// HandleEventRelationships is an option which serves MSC2836's
+// `POST /_matrix/federation/unstable/event_relationships`, walking `m.relates_to` relations from the given
+// `event_id` up to `limit`/`max_depth` in `direction`, for rooms present on this server.
+func HandleEventRelationships() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/unstable/event_relationships", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			var body struct {
+				EventID   string `json:"event_id"`
+				RoomID    string `json:"room_id"`
+				RelType   string `json:"rel_type"`
+				EventType string `json:"event_type"`
+				Direction string `json:"direction"`
+				Limit     int    `json:"limit"`
+				MaxDepth  int    `json:"max_depth"`
+			}
+			if err := json.Unmarshal(fedReq.Content(), &body); err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("complement: HandleEventRelationships cannot parse request body: " + err.Error()))
+				return
+			}
+			if body.Limit <= 0 {
+				body.Limit = 50
+			}
+			if body.MaxDepth <= 0 {
+				body.MaxDepth = 3
+			}
+			room, ok := s.rooms[body.RoomID]
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte("complement: HandleEventRelationships unexpected room ID: " + body.RoomID))
+				return
+			}
+			events := room.WalkRelations(body.EventID, body.RelType, body.EventType, body.Direction, body.MaxDepth, body.Limit)
+			b, err := json.Marshal(map[string]interface{}{
+				"events":     eventsToRawJSON(events),
+				"next_batch": nil,
+				"auth_chain": room.AuthChain(),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleEventRelationships cannot marshal response: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("POST")
+	}
+}
+
+// HandleSpacesSummary is an option which serves the space hierarchy endpoint, both the stable
+// `GET /_matrix/federation/v1/hierarchy/{roomID}` and the older
+// `GET /_matrix/federation/unstable/org.matrix.msc2946/spaces/{roomID}` path, summarising the `m.space.child`
+// state of rooms present on this server.
+func HandleSpacesSummary() func(*Server) {
+	return func(s *Server) {
+		fn := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			roomID := mux.Vars(req)["roomID"]
+			if _, ok := s.rooms[roomID]; !ok {
+				w.WriteHeader(404)
+				w.Write([]byte("complement: HandleSpacesSummary unexpected room ID: " + roomID))
+				return
+			}
+			b, err := json.Marshal(map[string]interface{}{
+				"rooms":      s.SpaceHierarchy(roomID),
+				"next_batch": nil,
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleSpacesSummary cannot marshal response: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})
+		s.mux.Handle("/_matrix/federation/v1/hierarchy/{roomID}", fn).Methods("GET")
+		s.mux.Handle("/_matrix/federation/unstable/org.matrix.msc2946/spaces/{roomID}", fn).Methods("GET")
+	}
+}
+
+// relatesToEventID returns the `m.relates_to.event_id` content field of ev, or "" if it doesn't relate to
+// anything.
+func relatesToEventID(ev *gomatrixserverlib.Event) string {
+	return gjson.GetBytes(ev.Content(), `m\.relates_to.event_id`).Str
+}
+
+// relatesToType returns the `m.relates_to.rel_type` content field of ev, or "" if it doesn't relate to
+// anything.
+func relatesToType(ev *gomatrixserverlib.Event) string {
+	return gjson.GetBytes(ev.Content(), `m\.relates_to.rel_type`).Str
+}
+
+// WalkRelations implements the MSC2836 walk: starting at eventID, follows `m.relates_to` edges outward up to
+// maxDepth hops, collecting at most limit related events (not including the starting event itself).
+// direction "up" follows the relation towards the event being related to (the "parent"); any other direction
+// follows relations towards events which relate to the current one (the "children"). relType/eventType, when
+// non-empty, filter which related events are returned.
+func (r *ServerRoom) WalkRelations(eventID, relType, eventType, direction string, maxDepth, limit int) []*gomatrixserverlib.Event {
+	matches := func(ev *gomatrixserverlib.Event) bool {
+		if eventType != "" && ev.Type() != eventType {
+			return false
+		}
+		if relType != "" && relatesToType(ev) != relType {
+			return false
+		}
+		return true
+	}
+	var related []*gomatrixserverlib.Event
+	if direction == "up" {
+		current := eventID
+		for depth := 0; depth < maxDepth && len(related) < limit; depth++ {
+			ev := r.eventByID(current)
+			if ev == nil {
+				break
+			}
+			parentID := relatesToEventID(ev)
+			if parentID == "" {
+				break
+			}
+			parent := r.eventByID(parentID)
+			if parent == nil {
+				break
+			}
+			if matches(parent) {
+				related = append(related, parent)
+			}
+			current = parentID
+		}
+		return related
+	}
+	frontier := []string{eventID}
+	for depth := 0; depth < maxDepth && len(frontier) > 0 && len(related) < limit; depth++ {
+		var next []string
+	timeline:
+		for _, ev := range r.Timeline {
+			parentID := relatesToEventID(ev)
+			if parentID == "" {
+				continue
+			}
+			for _, id := range frontier {
+				if parentID != id {
+					continue
+				}
+				if matches(ev) {
+					related = append(related, ev)
+				}
+				next = append(next, ev.EventID())
+				if len(related) >= limit {
+					break timeline
+				}
+			}
+		}
+		frontier = next
+	}
+	return related
+}
+
+// SpaceChildEvents returns every current `m.space.child` state event in this room that has a non-empty
+// `via` list (i.e. actually points at a child room, rather than retracting one).
+func (r *ServerRoom) SpaceChildEvents() []*gomatrixserverlib.Event {
+	var children []*gomatrixserverlib.Event
+	for _, ev := range r.AllCurrentState() {
+		if ev.Type() != "m.space.child" {
+			continue
+		}
+		if len(gjson.GetBytes(ev.Content(), "via").Array()) == 0 {
+			continue
+		}
+		children = append(children, ev)
+	}
+	return children
+}
+
+// SpaceSummary returns this room's MSC2946 summary fields, derived from its current state, without the
+// `children_state` field (which is appended separately by Server.SpaceHierarchy).
+func (r *ServerRoom) SpaceSummary() map[string]interface{} {
+	summary := map[string]interface{}{
+		"room_id": r.RoomID,
+	}
+	numJoined := 0
+	for _, ev := range r.AllCurrentState() {
+		switch ev.Type() {
+		case "m.room.name":
+			summary["name"] = gjson.GetBytes(ev.Content(), "name").Str
+		case "m.room.topic":
+			summary["topic"] = gjson.GetBytes(ev.Content(), "topic").Str
+		case "m.room.avatar":
+			summary["avatar_url"] = gjson.GetBytes(ev.Content(), "url").Str
+		case "m.room.canonical_alias":
+			summary["canonical_alias"] = gjson.GetBytes(ev.Content(), "alias").Str
+		case "m.room.join_rules":
+			summary["join_rule"] = gjson.GetBytes(ev.Content(), "join_rule").Str
+		case "m.room.guest_access":
+			summary["guest_can_join"] = gjson.GetBytes(ev.Content(), "guest_access").Str == "can_join"
+		case "m.room.history_visibility":
+			summary["world_readable"] = gjson.GetBytes(ev.Content(), "history_visibility").Str == "world_readable"
+		case "m.room.create":
+			if roomType := gjson.GetBytes(ev.Content(), "type").Str; roomType != "" {
+				summary["room_type"] = roomType
+			}
+		case "m.room.member":
+			if gjson.GetBytes(ev.Content(), "membership").Str == "join" {
+				numJoined++
+			}
+		}
+	}
+	summary["num_joined_members"] = numJoined
+	return summary
+}
+
+// SpaceHierarchy walks the `m.space.child` edges outward from roomID breadth-first, returning one summary
+// per room discovered (roomID first, followed by its children in the order their `m.space.child` events
+// appear), each annotated with its own `children_state`. Rooms referenced by an `m.space.child` event but not
+// known to this server are included as a minimal stub (room_id and an empty children_state) so the shape of the wider hierarchy is
+// still visible to the caller.
+func (s *Server) SpaceHierarchy(roomID string) []map[string]interface{} {
+	var out []map[string]interface{}
+	visited := map[string]bool{}
+	queue := []string{roomID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		room, ok := s.rooms[id]
+		if !ok {
+			out = append(out, map[string]interface{}{
+				"room_id":        id,
+				"children_state": []json.RawMessage{},
+			})
+			continue
+		}
+		childEvents := room.SpaceChildEvents()
+		summary := room.SpaceSummary()
+		summary["children_state"] = eventsToRawJSON(childEvents)
+		out = append(out, summary)
+		for _, ev := range childEvents {
+			if ev.StateKey() != nil {
+				queue = append(queue, *ev.StateKey())
+			}
+		}
+	}
+	return out
+}
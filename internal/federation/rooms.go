@@ -0,0 +1,423 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// MustMakeRoom creates a new ServerRoom for events[0]'s room ID, seeded with the given timeline events, and
+// registers it on this Server so HandleInviteRequests/HandleMakeSendJoinRequests/HandleStateRequests/etc can
+// serve it. version is recorded on the room up front (via roomVersionOrDefault) rather than inferred from
+// events afterwards, so make_join always reports back the version the room was actually created with. Fails
+// the test if events is empty.
+func (s *Server) MustMakeRoom(t *testing.T, version gomatrixserverlib.RoomVersion, events []*gomatrixserverlib.Event) *ServerRoom {
+	t.Helper()
+	if len(events) == 0 {
+		t.Fatalf("complement: MustMakeRoom needs at least one event")
+	}
+	room := &ServerRoom{
+		RoomID:  events[0].RoomID(),
+		Version: roomVersionOrDefault(version),
+	}
+	for _, ev := range events {
+		room.AddEvent(ev)
+	}
+	if s.rooms == nil {
+		s.rooms = make(map[string]*ServerRoom)
+	}
+	s.rooms[room.RoomID] = room
+	return room
+}
+
+// HandleInviteRequests is an option which will process invite requests for rooms which are present on this
+// server, inserting the invite event into the room state as-is (no checks are done on the invite's validity,
+// as with HandleMakeSendJoinRequests). To add a room to this server, see Server.MustMakeRoom.
+func HandleInviteRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v2/invite/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+			)
+			if fedReq == nil {
+				w.WriteHeader(errResp.Code)
+				b, _ := json.Marshal(errResp.JSON)
+				w.Write(b)
+				return
+			}
+			vars := mux.Vars(req)
+			roomID := vars["roomID"]
+			room, ok := s.rooms[roomID]
+			if !ok {
+				w.WriteHeader(404)
+				w.Write([]byte("complement: HandleInviteRequests unexpected room ID: " + roomID))
+				return
+			}
+			roomVer := room.Version
+			eventJSON := gjson.GetBytes(fedReq.Content(), "event").Raw
+			event, err := gomatrixserverlib.NewEventFromUntrustedJSON([]byte(eventJSON), roomVer)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleInviteRequests cannot parse invite event: " + err.Error()))
+				return
+			}
+			room.AddEvent(&event)
+			b, err := json.Marshal(map[string]interface{}{
+				"event": json.RawMessage(event.JSON()),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleInviteRequests cannot marshal response: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("PUT")
+	}
+}
+
+// HandleStateRequests is an option which serves `/state/{roomID}` and `/state_ids/{roomID}`, filtered to the
+// state before the event given in the `event_id` query parameter, for rooms present on this server.
+func HandleStateRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/state/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			room, ok := s.stateRequestRoom(w, req)
+			if !ok {
+				return
+			}
+			eventID := req.URL.Query().Get("event_id")
+			b, err := json.Marshal(gomatrixserverlib.RespState{
+				AuthEvents:  room.AuthChainFor(eventID),
+				StateEvents: room.StateAt(eventID),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleStateRequests cannot marshal RespState: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+
+		s.mux.Handle("/_matrix/federation/v1/state_ids/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			room, ok := s.stateRequestRoom(w, req)
+			if !ok {
+				return
+			}
+			eventID := req.URL.Query().Get("event_id")
+			b, err := json.Marshal(gomatrixserverlib.RespStateIDs{
+				AuthEventIDs:  eventIDs(room.AuthChainFor(eventID)),
+				StateEventIDs: eventIDs(room.StateAt(eventID)),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleStateRequests cannot marshal RespStateIDs: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
+
+// stateRequestRoom verifies the federation signature and resolves the roomID in the request path to a
+// known ServerRoom, writing an error response and returning ok=false if either step fails.
+func (s *Server) stateRequestRoom(w http.ResponseWriter, req *http.Request) (*ServerRoom, bool) {
+	fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+		req, time.Now(), gomatrixserverlib.ServerName(s.ServerName), s.keyRing,
+	)
+	if fedReq == nil {
+		w.WriteHeader(errResp.Code)
+		b, _ := json.Marshal(errResp.JSON)
+		w.Write(b)
+		return nil, false
+	}
+	// VerifyHTTPRequest consumed the body; restore it for handlers which parse it (e.g. get_missing_events).
+	req.Body = ioutil.NopCloser(bytes.NewReader(fedReq.Content()))
+	roomID := mux.Vars(req)["roomID"]
+	room, ok := s.rooms[roomID]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("complement: unexpected room ID: " + roomID))
+		return nil, false
+	}
+	return room, true
+}
+
+// HandleEventAuthRequests is an option which serves `/event_auth/{roomID}/{eventID}`, returning the auth
+// chain for the given event, for rooms present on this server.
+func HandleEventAuthRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/event_auth/{roomID}/{eventID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			room, ok := s.stateRequestRoom(w, req)
+			if !ok {
+				return
+			}
+			eventID := mux.Vars(req)["eventID"]
+			b, err := json.Marshal(map[string]interface{}{
+				"auth_chain": room.AuthChainFor(eventID),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleEventAuthRequests cannot marshal response: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
+
+// HandleBackfillRequests is an option which serves `/backfill/{roomID}`, walking backwards from the `v`
+// query parameter event IDs up to `limit` events, for rooms present on this server.
+func HandleBackfillRequests() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/backfill/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			room, ok := s.stateRequestRoom(w, req)
+			if !ok {
+				return
+			}
+			limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+			if err != nil || limit <= 0 {
+				limit = 10
+			}
+			events := room.BackfillFrom(req.URL.Query()["v"], limit)
+			b, err := json.Marshal(gomatrixserverlib.Transaction{
+				Origin:         gomatrixserverlib.ServerName(s.ServerName),
+				OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+				PDUs:           eventsToRawJSON(events),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleBackfillRequests cannot marshal response: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("GET")
+	}
+}
+
+// HandleGetMissingEvents is an option which serves `POST /get_missing_events/{roomID}`, resolving the gap
+// between `earliest_events` and `latest_events` (bounded by `limit` and `min_depth`), for rooms present on
+// this server.
+func HandleGetMissingEvents() func(*Server) {
+	return func(s *Server) {
+		s.mux.Handle("/_matrix/federation/v1/get_missing_events/{roomID}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			room, ok := s.stateRequestRoom(w, req)
+			if !ok {
+				return
+			}
+			reqBody, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleGetMissingEvents cannot read request body: " + err.Error()))
+				return
+			}
+			var body struct {
+				EarliestEvents []string `json:"earliest_events"`
+				LatestEvents   []string `json:"latest_events"`
+				Limit          int      `json:"limit"`
+				MinDepth       int64    `json:"min_depth"`
+			}
+			if err := json.Unmarshal(reqBody, &body); err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte("complement: HandleGetMissingEvents cannot parse request body: " + err.Error()))
+				return
+			}
+			if body.Limit <= 0 {
+				body.Limit = 10
+			}
+			events := room.MissingEvents(body.EarliestEvents, body.LatestEvents, body.MinDepth, body.Limit)
+			b, err := json.Marshal(map[string]interface{}{
+				"events": eventsToRawJSON(events),
+			})
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte("complement: HandleGetMissingEvents cannot marshal response: " + err.Error()))
+				return
+			}
+			w.WriteHeader(200)
+			w.Write(b)
+		})).Methods("POST")
+	}
+}
+
+// eventByID returns the event with the given ID from this room's timeline, or nil if the timeline does not
+// (yet) contain it.
+func (r *ServerRoom) eventByID(eventID string) *gomatrixserverlib.Event {
+	for _, ev := range r.Timeline {
+		if ev.EventID() == eventID {
+			return ev
+		}
+	}
+	return nil
+}
+
+// AuthChainFor returns the transitive auth chain for eventID: its auth_events, the auth_events of those
+// events, and so on, deduplicated. Returns nil if eventID is not known to this room.
+func (r *ServerRoom) AuthChainFor(eventID string) []*gomatrixserverlib.Event {
+	target := r.eventByID(eventID)
+	if target == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var chain []*gomatrixserverlib.Event
+	var walk func(ids []string)
+	walk = func(ids []string) {
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			ev := r.eventByID(id)
+			if ev == nil {
+				continue
+			}
+			chain = append(chain, ev)
+			walk(ev.AuthEventIDs())
+		}
+	}
+	walk(target.AuthEventIDs())
+	return chain
+}
+
+// StateAt returns the room state immediately prior to eventID, computed by replaying this room's timeline in
+// the order events were added and keeping the latest event for each (type, state_key) pair seen before
+// eventID. This mirrors AllCurrentState's last-write-wins semantics rather than doing full state resolution,
+// which is enough for the synthetic DAGs blueprints construct.
+func (r *ServerRoom) StateAt(eventID string) []*gomatrixserverlib.Event {
+	type stateTuple struct {
+		evType   string
+		stateKey string
+	}
+	state := make(map[stateTuple]*gomatrixserverlib.Event)
+	var order []stateTuple
+	for _, ev := range r.Timeline {
+		if ev.EventID() == eventID {
+			break
+		}
+		if ev.StateKey() == nil {
+			continue
+		}
+		key := stateTuple{ev.Type(), *ev.StateKey()}
+		if _, ok := state[key]; !ok {
+			order = append(order, key)
+		}
+		state[key] = ev
+	}
+	events := make([]*gomatrixserverlib.Event, 0, len(order))
+	for _, key := range order {
+		events = append(events, state[key])
+	}
+	return events
+}
+
+// BackfillFrom walks backwards from the events in v (via prev_events) breadth-first, collecting up to limit
+// events not already present in v, and returns them newest-first for embedding in a backfill Transaction.
+func (r *ServerRoom) BackfillFrom(v []string, limit int) []*gomatrixserverlib.Event {
+	visited := make(map[string]bool, len(v))
+	for _, id := range v {
+		visited[id] = true
+	}
+	queue := append([]string{}, v...)
+	var collected []*gomatrixserverlib.Event
+	for len(queue) > 0 && len(collected) < limit {
+		id := queue[0]
+		queue = queue[1:]
+		ev := r.eventByID(id)
+		if ev == nil {
+			continue
+		}
+		for _, prevID := range ev.PrevEventIDs() {
+			if visited[prevID] {
+				continue
+			}
+			visited[prevID] = true
+			prevEv := r.eventByID(prevID)
+			if prevEv == nil {
+				continue
+			}
+			collected = append(collected, prevEv)
+			queue = append(queue, prevID)
+			if len(collected) >= limit {
+				break
+			}
+		}
+	}
+	sort.Slice(collected, func(i, j int) bool {
+		return collected[i].Depth() > collected[j].Depth()
+	})
+	return collected
+}
+
+// MissingEvents walks backwards from latestEvents (via prev_events) to find events the caller is missing: it
+// stops at any event in earliestEvents (exclusive), at minDepth, or once limit new events have been
+// collected. latestEvents themselves are not included in the result. Returned events are oldest-first so a
+// caller can apply them in DAG order.
+func (r *ServerRoom) MissingEvents(earliestEvents, latestEvents []string, minDepth int64, limit int) []*gomatrixserverlib.Event {
+	boundary := make(map[string]bool, len(earliestEvents))
+	for _, id := range earliestEvents {
+		boundary[id] = true
+	}
+	visited := make(map[string]bool, len(latestEvents))
+	for _, id := range latestEvents {
+		visited[id] = true
+	}
+	queue := append([]string{}, latestEvents...)
+	var collected []*gomatrixserverlib.Event
+	for len(queue) > 0 && len(collected) < limit {
+		id := queue[0]
+		queue = queue[1:]
+		ev := r.eventByID(id)
+		if ev == nil {
+			continue
+		}
+		for _, prevID := range ev.PrevEventIDs() {
+			if visited[prevID] || boundary[prevID] {
+				continue
+			}
+			visited[prevID] = true
+			prevEv := r.eventByID(prevID)
+			if prevEv == nil || prevEv.Depth() < minDepth {
+				continue
+			}
+			collected = append(collected, prevEv)
+			queue = append(queue, prevID)
+			if len(collected) >= limit {
+				break
+			}
+		}
+	}
+	sort.Slice(collected, func(i, j int) bool {
+		return collected[i].Depth() < collected[j].Depth()
+	})
+	return collected
+}
+
+// eventIDs returns the event ID of every event in `events`, preserving order.
+func eventIDs(events []*gomatrixserverlib.Event) []string {
+	ids := make([]string, len(events))
+	for i, ev := range events {
+		ids[i] = ev.EventID()
+	}
+	return ids
+}
+
+// eventsToRawJSON converts events to their raw JSON form, for embedding in a transaction/backfill response.
+func eventsToRawJSON(events []*gomatrixserverlib.Event) []json.RawMessage {
+	raw := make([]json.RawMessage, len(events))
+	for i, ev := range events {
+		raw[i] = ev.JSON()
+	}
+	return raw
+}
@@ -0,0 +1,18 @@
+package federation
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultRoomVersion is the room version used by Server.MustMakeRoom when no RoomVersion is given. It is not
+// the newest entry of b.SupportedRoomVersions.
+const DefaultRoomVersion = gomatrixserverlib.RoomVersionV6
+
+// roomVersionOrDefault returns v if it is non-empty, else DefaultRoomVersion. Room construction should call
+// this rather than defaulting ad-hoc, so make_join/send_join always agree with how the room was created.
+func roomVersionOrDefault(v gomatrixserverlib.RoomVersion) gomatrixserverlib.RoomVersion {
+	if v == "" {
+		return DefaultRoomVersion
+	}
+	return v
+}
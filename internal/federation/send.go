@@ -0,0 +1,63 @@
+package federation
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// SendTransaction PDU-pushes `e` to `destination` via `/_matrix/federation/v1/send/{txnID}`, signing the
+// request as this server. It does not wait for the event to be accepted; callers which need that should
+// follow up with a sync/messages request on the target homeserver's client API.
+func (s *Server) SendTransaction(destination string, e *gomatrixserverlib.Event) error {
+	txn := gomatrixserverlib.Transaction{
+		Origin:         gomatrixserverlib.ServerName(s.ServerName),
+		OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+		Destination:    gomatrixserverlib.ServerName(destination),
+		PDUs:           []json.RawMessage{e.JSON()},
+	}
+	body, err := json.Marshal(txn)
+	if err != nil {
+		return fmt.Errorf("complement: SendTransaction cannot marshal transaction: %w", err)
+	}
+	txnID := fmt.Sprintf("complement-%d", time.Now().UnixNano())
+	path := fmt.Sprintf("/_matrix/federation/v1/send/%s", txnID)
+	req, err := gomatrixserverlib.NewFederationRequest("PUT", gomatrixserverlib.ServerName(destination), path)
+	if err != nil {
+		return fmt.Errorf("complement: SendTransaction cannot create federation request: %w", err)
+	}
+	if err = req.SetContent(json.RawMessage(body)); err != nil {
+		return fmt.Errorf("complement: SendTransaction cannot set request content: %w", err)
+	}
+	if err = req.Sign(gomatrixserverlib.ServerName(s.ServerName), s.KeyID, s.Priv); err != nil {
+		return fmt.Errorf("complement: SendTransaction cannot sign request: %w", err)
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return fmt.Errorf("complement: SendTransaction cannot build HTTP request: %w", err)
+	}
+	res, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("complement: SendTransaction failed to send transaction: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("complement: SendTransaction %s returned HTTP %d", path, res.StatusCode)
+	}
+	return nil
+}
+
+// Inject adds `e` to the named room on this server as if it had arrived over federation, without sending
+// any network request. Useful for building up DAG state (including forks) for HandleBackfillRequests /
+// HandleGetMissingEvents / HandleStateRequests to serve back.
+func (s *Server) Inject(roomID string, e *gomatrixserverlib.Event) error {
+	room, ok := s.rooms[roomID]
+	if !ok {
+		return fmt.Errorf("complement: Inject unknown room ID %s", roomID)
+	}
+	room.AddEvent(e)
+	return nil
+}